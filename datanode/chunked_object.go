@@ -0,0 +1,266 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package datanode
+
+import (
+	"encoding/json"
+	"hash/crc32"
+	"net"
+
+	"github.com/juju/errors"
+	"github.com/tiglabs/containerfs/proto"
+	"github.com/tiglabs/containerfs/util"
+	"github.com/tiglabs/containerfs/util/log"
+)
+
+func crc32OfChunk(data []byte) uint32 {
+	return crc32.ChecksumIEEE(data)
+}
+
+// ChunkedObjectThreshold is the write size above which handleWrite splits an
+// ExtentStore write at offset 0 into needle-style chunks of this size and stores a
+// manifest extent instead of one extent.
+const ChunkedObjectThreshold = 32 * util.BlockSize
+
+// maxManifestSize bounds how large a manifest extent's own JSON body can be, since it
+// only ever carries chunk metadata, never object bytes.
+const maxManifestSize = 1 << 20
+
+// manifestMagic prefixes a manifest extent's body so handleRead/handleStreamRead can
+// tell it apart from a plain extent without a side-channel flag.
+var manifestMagic = []byte("CFSMANIFEST1")
+
+// chunkPlacementParams carries the per-partition chunk-host assignment the master hands
+// down alongside an OpCreateDataPartition task, decoded from the same task.Request bytes
+// as proto.CreateDataPartitionRequest and ecCreateParams. A chunked write distributes its
+// chunks round-robin across Hosts instead of always placing them on the local disk.
+type chunkPlacementParams struct {
+	Hosts []string `json:"chunkHosts"`
+}
+
+// chunkRef is one piece of a chunked object, possibly living on a sibling datanode
+// when the master spread the chunks across the replica set's siblings.
+type chunkRef struct {
+	FileID uint64 `json:"fileID"`
+	Host   string `json:"host,omitempty"`
+	Offset int64  `json:"offset"`
+	Size   uint32 `json:"size"`
+	Crc    uint32 `json:"crc"`
+}
+
+// objectManifest is the primary extent's body for a chunked object: it carries no
+// object bytes itself, only the chunk layout needed to stitch a read back together.
+type objectManifest struct {
+	Chunks      []chunkRef `json:"chunks"`
+	TotalSize   int64      `json:"totalSize"`
+	ContentCrc  uint32     `json:"contentCrc"`
+}
+
+func isManifest(data []byte) bool {
+	return len(data) >= len(manifestMagic) && string(data[:len(manifestMagic)]) == string(manifestMagic)
+}
+
+func marshalManifest(m *objectManifest) ([]byte, error) {
+	body, err := json.Marshal(m)
+	if err != nil {
+		return nil, errors.Annotatef(err, "marshal objectManifest")
+	}
+	return append(append([]byte{}, manifestMagic...), body...), nil
+}
+
+func unmarshalManifest(data []byte) (*objectManifest, error) {
+	if !isManifest(data) {
+		return nil, errors.New("not a chunked-object manifest")
+	}
+	m := &objectManifest{}
+	if err := json.Unmarshal(data[len(manifestMagic):], m); err != nil {
+		return nil, errors.Annotatef(err, "unmarshal objectManifest")
+	}
+	return m, nil
+}
+
+// readManifestRange resolves a byte-range read against a chunked object's manifest,
+// stitching together only the chunks overlapping [offset, offset+size) so a partial
+// range read does not have to fetch the whole object.
+func (s *DataNode) readManifestRange(dp *dataPartition, m *objectManifest, offset int64, size int64) ([]byte, error) {
+	out := make([]byte, 0, size)
+	end := offset + size
+	var chunkStart int64
+	for _, c := range m.Chunks {
+		chunkEnd := chunkStart + int64(c.Size)
+		if chunkEnd > offset && chunkStart < end {
+			readOff := util.Max(0, offset-chunkStart)
+			readEnd := util.Min(int64(c.Size), end-chunkStart)
+			buf, err := s.readChunk(dp, c, readOff, readEnd-readOff)
+			if err != nil {
+				return nil, errors.Annotatef(err, "read chunk(fileID=%v)", c.FileID)
+			}
+			out = append(out, buf...)
+		}
+		chunkStart = chunkEnd
+	}
+	return out, nil
+}
+
+// readChunk reads one chunk of a chunked object, fanning out to a sibling datanode via
+// OpRead when the chunk was placed off-box by the master, or reading locally otherwise.
+func (s *DataNode) readChunk(dp *dataPartition, c chunkRef, offset, size int64) ([]byte, error) {
+	if c.Host == "" || c.Host == s.localServeAddr {
+		buf := make([]byte, size)
+		_, err := dp.GetExtentStore().Read(c.FileID, c.Offset+offset, size, buf)
+		return buf, err
+	}
+	return s.readRemoteChunk(c.Host, dp.ID(), c.FileID, c.Offset+offset, size)
+}
+
+// readRemoteChunk issues an OpRead against a sibling datanode holding one chunk of a
+// chunked object, using the same request/reply Packet convention as fetchECShard.
+func (s *DataNode) readRemoteChunk(host string, partitionId uint32, fileID uint64, offset, size int64) ([]byte, error) {
+	req := &Packet{}
+	req.Opcode = proto.OpRead
+	req.PartitionID = partitionId
+	req.FileID = fileID
+	req.Offset = offset
+	req.Size = uint32(size)
+	reply, err := s.sendPeerPacket(host, req)
+	if err != nil {
+		return nil, err
+	}
+	if reply.IsErrPack() {
+		return nil, errors.Errorf("readRemoteChunk: peer(%v) returned error(%v)", host, string(reply.Data[:reply.Size]))
+	}
+	return reply.Data[:reply.Size], nil
+}
+
+// loadManifestIfAny peeks at the head of pkg.FileID's primary extent and, if it carries
+// the manifest magic, parses and returns the full objectManifest. Returns a nil
+// manifest (not an error) for an ordinary, non-chunked extent.
+func (s *DataNode) loadManifestIfAny(pkg *Packet) (*objectManifest, error) {
+	dp, ok := pkg.DataPartition.(*dataPartition)
+	if !ok {
+		return nil, nil
+	}
+	store := dp.GetExtentStore()
+	fInfo, err := store.GetWatermark(pkg.FileID, false)
+	if err != nil || fInfo.Size < int64(len(manifestMagic)) || fInfo.Size > maxManifestSize {
+		return nil, nil
+	}
+	buf := make([]byte, fInfo.Size)
+	if _, err := store.Read(pkg.FileID, 0, fInfo.Size, buf); err != nil {
+		return nil, nil
+	}
+	if !isManifest(buf) {
+		return nil, nil
+	}
+	return unmarshalManifest(buf)
+}
+
+// chunkedObjectFileIDs derives one extent fileID per chunk of body from the manifest's
+// own fileID, since the client only ever allocates the single fileID a plain OpWrite
+// addresses. Chunk IDs are placed in the low 16 bits below the manifest's fileID so they
+// cannot collide with another object's extents; this caps a single partition at 65535
+// chunks per object, well above ChunkedObjectThreshold's largest practical object.
+func chunkedObjectFileIDs(manifestFileID uint64, body []byte) []uint64 {
+	n := (len(body) + ChunkedObjectThreshold - 1) / ChunkedObjectThreshold
+	ids := make([]uint64, n)
+	for i := range ids {
+		ids[i] = manifestFileID<<16 | uint64(i+1)
+	}
+	return ids
+}
+
+// forwardChunk ships one chunk's bytes to a sibling datanode via a plain OpWrite, the
+// same opcode a client would use, so the chunk actually lands on the host writeChunkedObject
+// assigned it instead of only ever existing in the manifest's metadata.
+func (s *DataNode) forwardChunk(host string, partitionId uint32, fileID uint64, data []byte, crc uint32) error {
+	req := &Packet{}
+	req.Opcode = proto.OpWrite
+	req.StoreMode = proto.ExtentStoreMode
+	req.PartitionID = partitionId
+	req.FileID = fileID
+	req.Offset = 0
+	req.Size = uint32(len(data))
+	req.Data = data
+	req.Crc = crc
+	reply, err := s.sendPeerPacket(host, req)
+	if err != nil {
+		return err
+	}
+	if reply.IsErrPack() {
+		return errors.Errorf("forwardChunk: peer(%v) returned error(%v)", host, string(reply.Data[:reply.Size]))
+	}
+	return nil
+}
+
+// writeChunkedObject splits body into ChunkedObjectThreshold-sized needle chunks and
+// distributes them round-robin across hosts (writing locally when a chunk's assigned
+// host is empty or is this node itself), so a multi-GiB object spreads across the
+// replica set's siblings instead of piling onto a single disk. The resulting manifest,
+// carrying each chunk's placement, is stored as the primary extent at manifestFileID.
+func (s *DataNode) writeChunkedObject(dp *dataPartition, manifestFileID uint64, chunkFileIDs []uint64, hosts []string, body []byte, contentCrc uint32) error {
+	store := dp.GetExtentStore()
+	m := &objectManifest{TotalSize: int64(len(body)), ContentCrc: contentCrc}
+	for i := 0; i < len(body); i += ChunkedObjectThreshold {
+		end := util.Min(i+ChunkedObjectThreshold, len(body))
+		chunk := body[i:end]
+		fileID := chunkFileIDs[i/ChunkedObjectThreshold]
+		crc := crc32OfChunk(chunk)
+		host := ""
+		if len(hosts) > 0 {
+			host = hosts[(i/ChunkedObjectThreshold)%len(hosts)]
+		}
+		ref := chunkRef{FileID: fileID, Offset: 0, Size: uint32(len(chunk)), Crc: crc}
+		if host == "" || host == s.localServeAddr {
+			if err := store.Create(fileID, 0, false); err != nil {
+				return errors.Annotatef(err, "create chunk extent(fileID=%v)", fileID)
+			}
+			if err := store.Write(fileID, 0, int64(len(chunk)), chunk, crc); err != nil {
+				return errors.Annotatef(err, "write chunk(fileID=%v)", fileID)
+			}
+		} else {
+			if err := s.forwardChunk(host, dp.ID(), fileID, chunk, crc); err != nil {
+				return errors.Annotatef(err, "forward chunk(fileID=%v) to host(%v)", fileID, host)
+			}
+			ref.Host = host
+		}
+		m.Chunks = append(m.Chunks, ref)
+	}
+	manifestBody, err := marshalManifest(m)
+	if err != nil {
+		return err
+	}
+	return store.Write(manifestFileID, 0, int64(len(manifestBody)), manifestBody, crc32OfChunk(manifestBody))
+}
+
+// handleStreamReadManifest is invoked from handleStreamRead once it detects the
+// primary extent holds a manifest rather than object bytes, and streams the
+// requested range back chunk by chunk instead of reading one extent linearly.
+func (s *DataNode) handleStreamReadManifest(request *Packet, connect net.Conn, m *objectManifest) {
+	buf, err := s.readManifestRange(request.DataPartition.(*dataPartition), m, request.Offset, int64(request.Size))
+	if err != nil {
+		request.PackErrorBody(ActionStreamRead, err.Error())
+		if werr := request.WriteToConn(connect); werr != nil {
+			log.LogErrorf(request.ActionMsg(ActionWriteToCli, connect.RemoteAddr().String(), request.StartT, werr))
+		}
+		return
+	}
+	request.Data = buf
+	request.Size = uint32(len(buf))
+	request.Crc = crc32OfChunk(buf)
+	request.ResultCode = proto.OpOk
+	if err := request.WriteToConn(connect); err != nil {
+		log.LogErrorf(request.ActionMsg(ActionWriteToCli, connect.RemoteAddr().String(), request.StartT, err))
+	}
+}
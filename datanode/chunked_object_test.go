@@ -0,0 +1,66 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package datanode
+
+import "testing"
+
+func TestManifestMarshalRoundTrip(t *testing.T) {
+	m := &objectManifest{
+		Chunks: []chunkRef{
+			{FileID: 1, Offset: 0, Size: 10, Crc: 123},
+			{FileID: 2, Offset: 0, Size: 20, Crc: 456},
+		},
+		TotalSize:  30,
+		ContentCrc: 789,
+	}
+	buf, err := marshalManifest(m)
+	if err != nil {
+		t.Fatalf("marshalManifest: %v", err)
+	}
+	if !isManifest(buf) {
+		t.Fatal("expected marshaled manifest to be recognized by isManifest")
+	}
+	got, err := unmarshalManifest(buf)
+	if err != nil {
+		t.Fatalf("unmarshalManifest: %v", err)
+	}
+	if got.TotalSize != m.TotalSize || got.ContentCrc != m.ContentCrc || len(got.Chunks) != len(m.Chunks) {
+		t.Fatalf("roundtrip mismatch: got %+v, want %+v", got, m)
+	}
+}
+
+func TestIsManifestRejectsOrdinaryExtent(t *testing.T) {
+	if isManifest([]byte("just some object bytes")) {
+		t.Fatal("ordinary extent data must not be mistaken for a manifest")
+	}
+}
+
+func TestChunkedObjectFileIDsAreUniquePerChunk(t *testing.T) {
+	body := make([]byte, ChunkedObjectThreshold*3+1)
+	ids := chunkedObjectFileIDs(42, body)
+	if len(ids) != 4 {
+		t.Fatalf("expected 4 chunk ids, got %v", len(ids))
+	}
+	seen := make(map[uint64]bool, len(ids))
+	for _, id := range ids {
+		if seen[id] {
+			t.Fatalf("duplicate chunk fileID %v", id)
+		}
+		seen[id] = true
+		if id>>16 != 42 {
+			t.Fatalf("chunk fileID %v does not derive from manifest fileID 42", id)
+		}
+	}
+}
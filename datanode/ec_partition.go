@@ -0,0 +1,351 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package datanode
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"net"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/klauspost/reedsolomon"
+	"github.com/tiglabs/containerfs/proto"
+	"github.com/tiglabs/containerfs/storage"
+	"github.com/tiglabs/containerfs/util"
+	"github.com/tiglabs/containerfs/util/log"
+)
+
+// ecPeerDialTimeout bounds how long a coordinator waits to reach a sibling shard-holder
+// before giving up on a forward/fetch, so one unreachable peer cannot stall a write or
+// a reconstruct indefinitely.
+const ecPeerDialTimeout = 5 * time.Second
+
+// opECShardTransfer is a datanode-to-datanode-only opcode carrying one already-encoded
+// shard verbatim (no re-encoding on receipt). It is never sent by clients or the master,
+// so it is defined locally instead of reserving a slot in proto's wire opcode space.
+const opECShardTransfer uint8 = 0xF0
+
+// ecCreateParams carries the EC stripe layout the master hands down alongside an
+// OpCreateDataPartition task. It is decoded from the same task.Request bytes as
+// proto.CreateDataPartitionRequest; a zero DataShards means the partition is an
+// ordinary replicated partition, not an EC one.
+type ecCreateParams struct {
+	DataShards   int      `json:"dataShards"`
+	ParityShards int      `json:"parityShards"`
+	ShardIndex   int      `json:"shardIndex"`
+	Peers        []string `json:"peers"`
+}
+
+// ecShardMeta describes the position a local dataPartition occupies inside an EC stripe
+// group. It is persisted alongside the partition so repair knows which row of the
+// generator matrix this shard owns without having to ask the master again.
+type ecShardMeta struct {
+	DataShards   int      `json:"dataShards"`
+	ParityShards int      `json:"parityShards"`
+	ShardIndex   int      `json:"shardIndex"`
+	Peers        []string `json:"peers"`
+}
+
+func (m *ecShardMeta) isParityShard() bool {
+	return m.ShardIndex >= m.DataShards
+}
+
+// ecEncoder builds the reedsolomon.Encoder for a given (k, m) pair. A new encoder is
+// built on every call; nothing is cached between calls.
+func ecEncoder(dataShards, parityShards int) (reedsolomon.Encoder, error) {
+	enc, err := reedsolomon.New(dataShards, parityShards)
+	if err != nil {
+		return nil, errors.Annotatef(err, "ecEncoder(%v,%v)", dataShards, parityShards)
+	}
+	return enc, nil
+}
+
+// splitStripe slices a single util.BlockSize-aligned chunk into dataShards equal pieces,
+// padding the final piece with zeroes when size does not divide evenly.
+func splitStripe(data []byte, dataShards int) [][]byte {
+	shardSize := (len(data) + dataShards - 1) / dataShards
+	shards := make([][]byte, dataShards)
+	for i := 0; i < dataShards; i++ {
+		shards[i] = make([]byte, shardSize)
+		start := i * shardSize
+		if start < len(data) {
+			end := util.Min(start+shardSize, len(data))
+			copy(shards[i], data[start:end])
+		}
+	}
+	return shards
+}
+
+// handleECWrite encodes an incoming chunk into data+parity shards and writes this
+// datanode's shard to the local ExtentStore. Once the local write succeeds it forwards
+// the sibling shards to the other members of the stripe via forwardECShards.
+func (s *DataNode) handleECWrite(pkg *Packet) {
+	var err error
+	defer func() {
+		if err != nil {
+			err = errors.Annotatef(err, "Request(%v) ECWrite Error", pkg.GetUniqueLogId())
+			pkg.PackErrorBody(LogECWrite, err.Error())
+		} else {
+			pkg.PackOkReply()
+		}
+	}()
+	dp := pkg.DataPartition.(*dataPartition)
+	if dp.Status() == proto.ReadOnly {
+		err = storage.ErrorPartitionReadOnly
+		return
+	}
+	meta := dp.ecMeta
+	if meta == nil {
+		err = ErrNotECPartition
+		return
+	}
+	enc, err := ecEncoder(meta.DataShards, meta.ParityShards)
+	if err != nil {
+		return
+	}
+	shards := make([][]byte, meta.DataShards+meta.ParityShards)
+	copy(shards, splitStripe(pkg.Data[:pkg.Size], meta.DataShards))
+	for i := meta.DataShards; i < len(shards); i++ {
+		shards[i] = make([]byte, len(shards[0]))
+	}
+	if err = enc.Encode(shards); err != nil {
+		err = errors.Annotatef(err, "encode stripe")
+		return
+	}
+	myShard := shards[meta.ShardIndex]
+	err = dp.GetExtentStore().Write(pkg.FileID, pkg.Offset, int64(len(myShard)), myShard, pkg.Crc)
+	s.addDiskErrs(pkg.PartitionID, err, WriteFlag)
+	if err == nil {
+		s.bumpRevision(dp)
+		s.forwardECShards(pkg.PartitionID, pkg.FileID, pkg.Offset, meta, shards)
+	}
+}
+
+// forwardECShards ships every shard this node just computed, other than its own, to the
+// sibling holding that shard index so an EC partition actually ends up striped with
+// redundancy instead of living entirely on the coordinator. Failures are logged, not
+// returned, so one unreachable peer does not fail the client's write of the shard this
+// node already committed locally; repair picks up the gap later via repairECShard.
+func (s *DataNode) forwardECShards(partitionId uint32, fileID uint64, offset int64, meta *ecShardMeta, shards [][]byte) {
+	for i, peer := range meta.Peers {
+		if i == meta.ShardIndex {
+			continue
+		}
+		if err := s.sendECShard(peer, partitionId, fileID, offset, shards[i]); err != nil {
+			log.LogErrorf("action[forwardECShards] partition(%v) shard(%v) peer(%v) err(%v)",
+				partitionId, i, peer, err)
+		}
+	}
+}
+
+// sendECShard delivers one pre-encoded shard to a sibling via opECShardTransfer, which
+// writes it verbatim without re-deriving it from the original object.
+func (s *DataNode) sendECShard(addr string, partitionId uint32, fileID uint64, offset int64, shard []byte) error {
+	req := &Packet{}
+	req.Opcode = opECShardTransfer
+	req.PartitionID = partitionId
+	req.FileID = fileID
+	req.Offset = offset
+	req.Size = uint32(len(shard))
+	req.Data = shard
+	req.Crc = crc32.ChecksumIEEE(shard)
+	reply, err := s.sendPeerPacket(addr, req)
+	if err != nil {
+		return err
+	}
+	if reply.IsErrPack() {
+		return fmt.Errorf("peer(%v) returned error(%v)", addr, string(reply.Data[:reply.Size]))
+	}
+	return nil
+}
+
+// sendPeerPacket dials addr, writes req and waits for the matching reply, using the same
+// request/reply Packet convention operatePacket uses for client connections.
+func (s *DataNode) sendPeerPacket(addr string, req *Packet) (*Packet, error) {
+	conn, err := net.DialTimeout("tcp", addr, ecPeerDialTimeout)
+	if err != nil {
+		return nil, errors.Annotatef(err, "dial peer(%v)", addr)
+	}
+	defer conn.Close()
+	if err = req.WriteToConn(conn); err != nil {
+		return nil, errors.Annotatef(err, "write request to peer(%v)", addr)
+	}
+	reply := &Packet{}
+	if err = reply.ReadFromConn(conn, proto.ReadDeadlineTime); err != nil {
+		return nil, errors.Annotatef(err, "read reply from peer(%v)", addr)
+	}
+	return reply, nil
+}
+
+// handleECShardTransfer is the receiving side of sendECShard: it writes the already-
+// encoded shard straight to the local ExtentStore, skipping the encode step entirely
+// since the coordinator has already done it.
+func (s *DataNode) handleECShardTransfer(pkg *Packet) {
+	var err error
+	defer func() {
+		if err != nil {
+			err = errors.Annotatef(err, "Request(%v) ECShardTransfer Error", pkg.GetUniqueLogId())
+			pkg.PackErrorBody(LogECWrite, err.Error())
+		} else {
+			pkg.PackOkReply()
+		}
+	}()
+	dp := pkg.DataPartition.(*dataPartition)
+	if dp.ecMeta == nil {
+		err = ErrNotECPartition
+		return
+	}
+	err = dp.GetExtentStore().Write(pkg.FileID, pkg.Offset, int64(pkg.Size), pkg.Data, pkg.Crc)
+	s.addDiskErrs(pkg.PartitionID, err, WriteFlag)
+	if err == nil {
+		s.bumpRevision(dp)
+	}
+}
+
+// handleECRead fetches this node's shard of a stripe. When the local shard is missing
+// the coordinator is expected to have already issued an OpECReconstruct instead.
+func (s *DataNode) handleECRead(pkg *Packet) {
+	dp := pkg.DataPartition.(*dataPartition)
+	if dp.ecMeta == nil {
+		pkg.PackErrorBody(LogECRead, ErrNotECPartition.Error())
+		return
+	}
+	pkg.Data = make([]byte, pkg.Size)
+	var err error
+	pkg.Crc, err = dp.GetExtentStore().Read(pkg.FileID, pkg.Offset, int64(pkg.Size), pkg.Data)
+	s.addDiskErrs(pkg.PartitionID, err, ReadFlag)
+	if err != nil {
+		pkg.PackErrorBody(LogECRead, err.Error())
+		return
+	}
+	pkg.PackOkReadReply()
+}
+
+// handleECReconstruct rebuilds this node's own shard (meta.ShardIndex) from the minimum
+// surviving set of sibling shards, fetched over the existing OpECRead path.
+func (s *DataNode) handleECReconstruct(pkg *Packet) {
+	var err error
+	defer func() {
+		if err != nil {
+			err = errors.Annotatef(err, "Request(%v) ECReconstruct Error", pkg.GetUniqueLogId())
+			pkg.PackErrorBody(LogECReconstruct, err.Error())
+		} else {
+			pkg.PackOkReply()
+		}
+	}()
+	dp := pkg.DataPartition.(*dataPartition)
+	meta := dp.ecMeta
+	if meta == nil {
+		err = ErrNotECPartition
+		return
+	}
+	enc, err := ecEncoder(meta.DataShards, meta.ParityShards)
+	if err != nil {
+		return
+	}
+	shards := make([][]byte, meta.DataShards+meta.ParityShards)
+	have := 0
+	for i, peer := range meta.Peers {
+		if i == meta.ShardIndex {
+			continue
+		}
+		shard, fetchErr := s.fetchECShard(peer, pkg.PartitionID, pkg.FileID, pkg.Offset, int64(pkg.Size))
+		if fetchErr != nil {
+			continue
+		}
+		shards[i] = shard
+		have++
+		if have >= meta.DataShards {
+			break
+		}
+	}
+	if have < meta.DataShards {
+		err = fmt.Errorf("only %v of %v required shards available", have, meta.DataShards)
+		return
+	}
+	if err = enc.Reconstruct(shards); err != nil {
+		err = errors.Annotatef(err, "reconstruct stripe")
+		return
+	}
+	err = dp.GetExtentStore().Write(pkg.FileID, pkg.Offset, int64(len(shards[meta.ShardIndex])), shards[meta.ShardIndex], 0)
+	s.addDiskErrs(pkg.PartitionID, err, WriteFlag)
+	if err == nil {
+		s.bumpRevision(dp)
+	}
+}
+
+// fetchECShard issues an OpECRead against a sibling datanode to retrieve one shard of a
+// stripe during reconstruction.
+func (s *DataNode) fetchECShard(addr string, partitionId uint32, fileID uint64, offset int64, size int64) ([]byte, error) {
+	req := &Packet{}
+	req.Opcode = proto.OpECRead
+	req.PartitionID = partitionId
+	req.FileID = fileID
+	req.Offset = offset
+	req.Size = uint32(size)
+	reply, err := s.sendPeerPacket(addr, req)
+	if err != nil {
+		return nil, err
+	}
+	if reply.IsErrPack() {
+		return nil, fmt.Errorf("fetchECShard: peer(%v) returned error(%v)", addr, string(reply.Data[:reply.Size]))
+	}
+	return reply.Data[:reply.Size], nil
+}
+
+// missingECShardFileIDs compares this node's local extents against the watermarks the
+// peers reported in MemberFileMetas and returns the fileIDs this shard does not have a
+// stripe for, which repairECShard then rebuilds from the other N peers.
+func missingECShardFileIDs(dp *dataPartition, mf *MemberFileMetas) []uint64 {
+	local, err := dp.GetExtentStore().GetAllWatermark(storage.GetStableExtentFilter())
+	if err != nil {
+		return nil
+	}
+	have := make(map[uint64]bool, len(local))
+	for _, fInfo := range local {
+		have[fInfo.FileId] = true
+	}
+	missing := make([]uint64, 0)
+	for fileID := range mf.Files {
+		if !have[fileID] {
+			missing = append(missing, fileID)
+		}
+	}
+	return missing
+}
+
+// repairECShard is invoked from handleNotifyExtentRepair when MemberFileMetas reports
+// this shard missing relative to its peers; it rebuilds the shard locally instead of
+// streaming a full replica copy, since only 1/(k+m) of the stripe lives on this node.
+// size must come from the peer-reported fInfo in mf.Files, not a local GetWatermark
+// lookup: fileID is, by construction, a file this node's ExtentStore does not have.
+func (dp *dataPartition) repairECShard(s *DataNode, fileID uint64, size int64) error {
+	if dp.ecMeta == nil {
+		return ErrNotECPartition
+	}
+	pkg := &Packet{}
+	pkg.PartitionID = dp.ID()
+	pkg.FileID = fileID
+	pkg.Offset = 0
+	pkg.Size = uint32(size)
+	pkg.DataPartition = dp
+	s.handleECReconstruct(pkg)
+	if pkg.IsErrPack() {
+		return fmt.Errorf("repairECShard(%v): %v", fileID, string(pkg.Data[:pkg.Size]))
+	}
+	return nil
+}
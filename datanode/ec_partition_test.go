@@ -0,0 +1,59 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package datanode
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSplitStripeEvenlyDivides(t *testing.T) {
+	data := []byte("abcdefgh")
+	shards := splitStripe(data, 4)
+	if len(shards) != 4 {
+		t.Fatalf("expected 4 shards, got %v", len(shards))
+	}
+	for _, shard := range shards {
+		if len(shard) != 2 {
+			t.Fatalf("expected shard len 2, got %v", len(shard))
+		}
+	}
+	if !bytes.Equal(shards[0], []byte("ab")) || !bytes.Equal(shards[3], []byte("gh")) {
+		t.Fatalf("unexpected shard contents: %v", shards)
+	}
+}
+
+func TestSplitStripePadsShortTail(t *testing.T) {
+	data := []byte("abcde")
+	shards := splitStripe(data, 2)
+	if len(shards) != 2 {
+		t.Fatalf("expected 2 shards, got %v", len(shards))
+	}
+	if len(shards[0]) != len(shards[1]) {
+		t.Fatalf("shards must be equal length for the encoder, got %v and %v", len(shards[0]), len(shards[1]))
+	}
+	if !bytes.Equal(shards[0], []byte("abc")) {
+		t.Fatalf("unexpected first shard: %v", shards[0])
+	}
+	if !bytes.Equal(shards[1], []byte("de\x00")) {
+		t.Fatalf("expected zero-padded tail shard, got %v", shards[1])
+	}
+}
+
+func TestEcEncoderRejectsInvalidShardCounts(t *testing.T) {
+	if _, err := ecEncoder(0, 2); err == nil {
+		t.Fatal("expected an error for zero data shards")
+	}
+}
@@ -0,0 +1,161 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package datanode
+
+import (
+	"encoding/json"
+
+	"github.com/juju/errors"
+	"golang.org/x/net/context"
+
+	"github.com/tiglabs/containerfs/datanode/grpc"
+	"github.com/tiglabs/containerfs/proto"
+	"github.com/tiglabs/containerfs/storage"
+)
+
+// grpcServer adapts the generated grpc.DataNodeServer interface onto the datanode: the
+// TCP packet path in operatePacket stays authoritative for the data plane, this is
+// purely a structured-errors/streaming front door for the admin/heartbeat opcodes the
+// master and operators drive. GetDataPartitionMetrics and the Notify* RPCs call the
+// existing handleXxx methods with an in-memory Packet; CreateDataPartition,
+// DeleteDataPartition, LoadDataPartition and Heartbeat call the space manager or
+// fillHeartBeatResponse directly and do not go through handleXxx.
+type grpcServer struct {
+	s *DataNode
+}
+
+// newGrpcServer returns a grpc.DataNodeServer backed by this datanode.
+func newGrpcServer(s *DataNode) grpc.DataNodeServer {
+	return &grpcServer{s: s}
+}
+
+// adminPacket builds the in-memory Packet a handleXxx method expects, without going
+// through the wire-decoding operatePacket normally does for TCP clients.
+func adminPacket(opcode uint8, partitionId uint32, body []byte) *Packet {
+	pkg := &Packet{}
+	pkg.Opcode = opcode
+	pkg.PartitionID = partitionId
+	pkg.Data = body
+	pkg.Size = uint32(len(body))
+	return pkg
+}
+
+func taskResponseFromPacket(pkg *Packet) (*grpc.TaskResponse, error) {
+	if pkg.IsErrPack() {
+		return &grpc.TaskResponse{Status: int32(proto.TaskFail), Result: string(pkg.Data[:pkg.Size])}, nil
+	}
+	return &grpc.TaskResponse{Status: int32(proto.TaskSuccess)}, nil
+}
+
+func (g *grpcServer) CreateDataPartition(ctx context.Context, req *grpc.CreateDataPartitionRequest) (*grpc.TaskResponse, error) {
+	if _, err := g.s.space.CreatePartition(req.VolumeId, req.PartitionId, req.PartitionSize, req.PartitionType); err != nil {
+		return &grpc.TaskResponse{Status: int32(proto.TaskFail), Result: err.Error()}, nil
+	}
+	return &grpc.TaskResponse{Status: int32(proto.TaskSuccess)}, nil
+}
+
+func (g *grpcServer) DeleteDataPartition(ctx context.Context, req *grpc.DeleteDataPartitionRequest) (*grpc.TaskResponse, error) {
+	g.s.space.DeletePartition(req.PartitionId)
+	return &grpc.TaskResponse{Status: int32(proto.TaskSuccess)}, nil
+}
+
+func (g *grpcServer) LoadDataPartition(ctx context.Context, req *grpc.LoadDataPartitionRequest) (*grpc.TaskResponse, error) {
+	dp := g.s.space.GetPartition(req.PartitionId)
+	if dp == nil {
+		return &grpc.TaskResponse{Status: int32(proto.TaskFail), Result: "dataPartition not found"}, nil
+	}
+	dp.(*dataPartition).Load()
+	return &grpc.TaskResponse{Status: int32(proto.TaskSuccess)}, nil
+}
+
+func (g *grpcServer) Heartbeat(ctx context.Context, req *grpc.HeartBeatRequest) (*grpc.TaskResponse, error) {
+	var response proto.DataNodeHeartBeatResponse
+	g.s.fillHeartBeatResponse(&response)
+	MasterHelper.AddNode(req.MasterAddr)
+	return &grpc.TaskResponse{Status: int32(proto.TaskSuccess)}, nil
+}
+
+func (g *grpcServer) GetDataPartitionMetrics(ctx context.Context, req *grpc.GetDataPartitionMetricsRequest) (*grpc.GetDataPartitionMetricsResponse, error) {
+	dp := g.s.space.GetPartition(req.PartitionId)
+	if dp == nil {
+		return nil, errors.Errorf("dataPartition(%v) not found", req.PartitionId)
+	}
+	pkg := adminPacket(proto.OpGetDataPartitionMetrics, req.PartitionId, nil)
+	pkg.DataPartition = dp
+	g.s.handleGetDataPartitionMetrics(pkg)
+	if pkg.IsErrPack() {
+		return nil, errors.New(string(pkg.Data[:pkg.Size]))
+	}
+	return &grpc.GetDataPartitionMetricsResponse{MetricsJson: pkg.Data[:pkg.Size]}, nil
+}
+
+func (g *grpcServer) NotifyExtentRepair(ctx context.Context, req *grpc.NotifyRepairRequest) (*grpc.TaskResponse, error) {
+	dp := g.s.space.GetPartition(req.PartitionId)
+	if dp == nil {
+		return &grpc.TaskResponse{Status: int32(proto.TaskFail), Result: "dataPartition not found"}, nil
+	}
+	pkg := adminPacket(proto.OpNotifyExtentRepair, req.PartitionId, req.MemberFileMetasJson)
+	pkg.DataPartition = dp
+	g.s.handleNotifyExtentRepair(pkg)
+	return taskResponseFromPacket(pkg)
+}
+
+func (g *grpcServer) NotifyBlobRepair(ctx context.Context, req *grpc.NotifyRepairRequest) (*grpc.TaskResponse, error) {
+	dp := g.s.space.GetPartition(req.PartitionId)
+	if dp == nil {
+		return &grpc.TaskResponse{Status: int32(proto.TaskFail), Result: "dataPartition not found"}, nil
+	}
+	pkg := adminPacket(proto.OpNotifyBlobRepair, req.PartitionId, req.MemberFileMetasJson)
+	pkg.DataPartition = dp
+	g.s.handleNotifyBlobRepair(pkg)
+	return taskResponseFromPacket(pkg)
+}
+
+func (g *grpcServer) NotifyCompactBlobFile(ctx context.Context, req *grpc.NotifyCompactRequest) (*grpc.TaskResponse, error) {
+	pkg := adminPacket(proto.OpNotifyCompactBlobFile, req.PartitionId, nil)
+	pkg.FileID = uint64(req.BlobFileId)
+	g.s.handleNotifyCompact(pkg)
+	return taskResponseFromPacket(pkg)
+}
+
+// GetAllWatermark streams the watermark list instead of buffering the whole, possibly
+// large, JSON array the TCP path returns in a single Packet body.
+func (g *grpcServer) GetAllWatermark(req *grpc.GetAllWatermarkRequest, stream grpc.DataNode_GetAllWatermarkServer) error {
+	dp := g.s.space.GetPartition(req.PartitionId)
+	if dp == nil {
+		return errors.New("dataPartition not found")
+	}
+	var fInfoList []*storage.FileInfo
+	var err error
+	switch req.StoreMode {
+	case "blob":
+		fInfoList, err = dp.(*dataPartition).GetBlobStore().GetAllWatermark()
+	default:
+		fInfoList, err = dp.(*dataPartition).GetExtentStore().GetAllWatermark(storage.GetStableExtentFilter())
+	}
+	if err != nil {
+		return err
+	}
+	for _, fInfo := range fInfoList {
+		buf, err := json.Marshal(fInfo)
+		if err != nil {
+			return err
+		}
+		if err := stream.Send(&grpc.WatermarkEntry{FileInfoJson: buf}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,23 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package datanode
+
+import "github.com/tiglabs/containerfs/datanode/grpc"
+
+// Compile-time proof that grpcServer implements every method grpc.DataNodeServer
+// declares, so a signature drift between this adapter and the generated interface
+// (see datanode/grpc/datanode_test.go for the serviceDesc dispatch-table coverage)
+// fails the build instead of surfacing as a runtime "unknown method" error.
+var _ grpc.DataNodeServer = (*grpcServer)(nil)
@@ -0,0 +1,227 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package datanode
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/tiglabs/containerfs/proto"
+	"github.com/tiglabs/containerfs/util/log"
+)
+
+// logEntry is one recorded mutation against a partition, enough for a downstream
+// indexer or replica to replay the write without re-reading the whole extent.
+type logEntry struct {
+	TsNs   int64  `json:"ts"`
+	Opcode uint8  `json:"op"`
+	FileID uint64 `json:"fileId"`
+	Offset int64  `json:"offset"`
+	Size   uint32 `json:"size"`
+	Crc    uint32 `json:"crc"`
+}
+
+// flushFunc persists a batch of log entries somewhere durable. The local disk segment
+// writer is the default; a deployment can plug in an external MQ by swapping this out.
+type flushFunc func(partitionId uint32, entries []logEntry) error
+
+// LogBuffer is a per-partition in-memory ring that buffers recent mutations for
+// OpSubscribePartitionLog subscribers and flushes them to an on-disk segment so a
+// subscriber can resume from a timestamp across restarts. A flush happens only when
+// the ring reaches capacity or Flush is called; there is no timed flush.
+type LogBuffer struct {
+	mu            sync.Mutex
+	partitionId   uint32
+	dir           string
+	ring          []logEntry
+	cap           int
+	flush         flushFunc
+	lastFlushTsNs int64 // atomic
+	stopC         chan bool
+}
+
+// NewLogBuffer creates a LogBuffer for a partition, rooted at <partitionDir>/log. The
+// ring capacity bounds memory use; entries older than the ring are only retrievable
+// from flushed segments.
+func NewLogBuffer(partitionId uint32, partitionDir string, capacity int) *LogBuffer {
+	lb := &LogBuffer{
+		partitionId: partitionId,
+		dir:         path.Join(partitionDir, "log"),
+		cap:         capacity,
+		stopC:       make(chan bool),
+	}
+	lb.flush = lb.flushToDisk
+	os.MkdirAll(lb.dir, 0755)
+	return lb
+}
+
+// SetFlushFunc overrides where flushed entries are shipped, e.g. to an external MQ
+// instead of the default on-disk segment.
+func (lb *LogBuffer) SetFlushFunc(f flushFunc) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	lb.flush = f
+}
+
+// Record appends a mutation to the ring. Once the ring holds cap entries, Record
+// flushes it synchronously before returning.
+func (lb *LogBuffer) Record(opcode uint8, fileId uint64, offset int64, size uint32, crc uint32, tsNs int64) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	lb.ring = append(lb.ring, logEntry{TsNs: tsNs, Opcode: opcode, FileID: fileId, Offset: offset, Size: size, Crc: crc})
+	if len(lb.ring) >= lb.cap {
+		lb.flushLocked()
+	}
+}
+
+func (lb *LogBuffer) flushLocked() {
+	if len(lb.ring) == 0 {
+		return
+	}
+	entries := lb.ring
+	lb.ring = nil
+	if err := lb.flush(lb.partitionId, entries); err != nil {
+		log.LogErrorf("action[LogBuffer.flush] partition(%v) err(%v)", lb.partitionId, err)
+		return
+	}
+	atomic.StoreInt64(&lb.lastFlushTsNs, entries[len(entries)-1].TsNs)
+}
+
+// Flush forces a synchronous flush of whatever is currently buffered.
+func (lb *LogBuffer) Flush() {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	lb.flushLocked()
+}
+
+// LastFlushTsNs is the timestamp of the newest entry durably flushed so far, updated
+// atomically so OpSubscribePartitionLog can answer "am I caught up" without locking.
+func (lb *LogBuffer) LastFlushTsNs() int64 {
+	return atomic.LoadInt64(&lb.lastFlushTsNs)
+}
+
+// flushToDisk is the default flushFunc: entries are appended as one rolling segment
+// file per flush window, named by the first entry's timestamp in decimal nanoseconds.
+func (lb *LogBuffer) flushToDisk(partitionId uint32, entries []logEntry) error {
+	segPath := path.Join(lb.dir, strconv.FormatInt(entries[0].TsNs, 10))
+	f, err := os.OpenFile(segPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return errors.Annotatef(err, "open log segment(%v)", segPath)
+	}
+	defer f.Close()
+	enc := json.NewEncoder(f)
+	for _, e := range entries {
+		if err := enc.Encode(e); err != nil {
+			return errors.Annotatef(err, "encode log entry")
+		}
+	}
+	return nil
+}
+
+// entriesSince reads every on-disk segment plus the buffered ring and keeps the entries
+// at or after fromTsNs, to serve an OpSubscribePartitionLog resume-from-timestamp request. The
+// combined result is sorted by timestamp, since segment directory order is lexical on
+// filename (not numeric) and the in-memory ring is appended after every segment read.
+func (lb *LogBuffer) entriesSince(fromTsNs int64) ([]logEntry, error) {
+	segments, err := ioutil.ReadDir(lb.dir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, errors.Annotatef(err, "read log dir(%v)", lb.dir)
+	}
+	out := make([]logEntry, 0)
+	for _, seg := range segments {
+		if _, err := strconv.ParseInt(seg.Name(), 10, 64); err != nil {
+			continue
+		}
+		data, err := ioutil.ReadFile(path.Join(lb.dir, seg.Name()))
+		if err != nil {
+			continue
+		}
+		dec := json.NewDecoder(bytes.NewReader(data))
+		for {
+			var e logEntry
+			if err := dec.Decode(&e); err != nil {
+				break
+			}
+			if e.TsNs >= fromTsNs {
+				out = append(out, e)
+			}
+		}
+	}
+	lb.mu.Lock()
+	for _, e := range lb.ring {
+		if e.TsNs >= fromTsNs {
+			out = append(out, e)
+		}
+	}
+	lb.mu.Unlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].TsNs < out[j].TsNs })
+	return out, nil
+}
+
+// recordMutation appends a mutation to the partition's LogBuffer, if one is attached.
+// Called after a write/delete/create is durably applied so OpSubscribePartitionLog
+// subscribers see it at least as soon as a client could re-read it.
+func (s *DataNode) recordMutation(dpi interface{}, opcode uint8, fileId uint64, offset int64, size uint32, crc uint32) {
+	dp, ok := dpi.(*dataPartition)
+	if !ok || dp.logBuffer == nil {
+		return
+	}
+	dp.logBuffer.Record(opcode, fileId, offset, size, crc, time.Now().UnixNano())
+}
+
+// handleSubscribePartitionLog streams the buffered ring plus any on-disk segments
+// newer than pkg.Offset (interpreted as a resume timestamp in nanoseconds) to the
+// subscriber, one JSON-encoded logEntry per reply Packet.
+func (s *DataNode) handleSubscribePartitionLog(pkg *Packet, conn net.Conn) {
+	dp, ok := pkg.DataPartition.(*dataPartition)
+	if !ok || dp.logBuffer == nil {
+		pkg.PackErrorBody(LogSubscribe, "partition has no log buffer attached")
+		if err := pkg.WriteToConn(conn); err != nil {
+			log.LogErrorf("action[handleSubscribePartitionLog] write error(%v)", err)
+		}
+		return
+	}
+	entries, err := dp.logBuffer.entriesSince(pkg.Offset)
+	if err != nil {
+		pkg.PackErrorBody(LogSubscribe, err.Error())
+		if err := pkg.WriteToConn(conn); err != nil {
+			log.LogErrorf("action[handleSubscribePartitionLog] write error(%v)", err)
+		}
+		return
+	}
+	for _, e := range entries {
+		buf, err := json.Marshal(e)
+		if err != nil {
+			continue
+		}
+		pkg.Data = buf
+		pkg.Size = uint32(len(buf))
+		pkg.ResultCode = proto.OpOk
+		if err := pkg.WriteToConn(conn); err != nil {
+			log.LogErrorf("action[handleSubscribePartitionLog] write error(%v)", err)
+			return
+		}
+	}
+}
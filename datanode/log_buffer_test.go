@@ -0,0 +1,59 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package datanode
+
+import "testing"
+
+func TestLogBufferEntriesSinceIsChronological(t *testing.T) {
+	lb := NewLogBuffer(1, t.TempDir(), 1)
+
+	// cap=1 forces every Record to flush its own segment, named after its own
+	// timestamp; segment "100" sorts before segment "20" lexically but after it
+	// numerically, which is exactly the ordering bug entriesSince must correct for.
+	lb.Record(0, 1, 0, 0, 0, 20)
+	lb.Record(0, 1, 0, 0, 0, 100)
+	lb.Record(0, 1, 0, 0, 0, 9)
+
+	entries, err := lb.entriesSince(0)
+	if err != nil {
+		t.Fatalf("entriesSince: %v", err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("expected 3 entries, got %v", len(entries))
+	}
+	for i := 1; i < len(entries); i++ {
+		if entries[i].TsNs < entries[i-1].TsNs {
+			t.Fatalf("entries not sorted: %v", entries)
+		}
+	}
+	if entries[0].TsNs != 9 || entries[2].TsNs != 100 {
+		t.Fatalf("unexpected order: %v", entries)
+	}
+}
+
+func TestLogBufferEntriesSinceFiltersByTimestamp(t *testing.T) {
+	lb := NewLogBuffer(1, t.TempDir(), 10)
+	lb.Record(0, 1, 0, 0, 0, 5)
+	lb.Record(0, 1, 0, 0, 0, 15)
+	lb.Flush()
+
+	entries, err := lb.entriesSince(10)
+	if err != nil {
+		t.Fatalf("entriesSince: %v", err)
+	}
+	if len(entries) != 1 || entries[0].TsNs != 15 {
+		t.Fatalf("expected only the entry at ts=15, got %v", entries)
+	}
+}
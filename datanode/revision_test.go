@@ -0,0 +1,58 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package datanode
+
+import "testing"
+
+func TestRevisionFileBumpPersists(t *testing.T) {
+	dir := t.TempDir()
+	rf, err := openRevisionFile(dir)
+	if err != nil {
+		t.Fatalf("openRevisionFile: %v", err)
+	}
+	if rf.Current() != 0 {
+		t.Fatalf("expected a fresh revision file to start at 0, got %v", rf.Current())
+	}
+	next, err := rf.Bump()
+	if err != nil {
+		t.Fatalf("Bump: %v", err)
+	}
+	if next != 1 || rf.Current() != 1 {
+		t.Fatalf("expected revision 1 after one bump, got %v (current=%v)", next, rf.Current())
+	}
+
+	rf.f.Sync()
+	reopened, err := openRevisionFile(dir)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	if reopened.Current() != 1 {
+		t.Fatalf("expected reopened revision file to recover counter 1, got %v", reopened.Current())
+	}
+}
+
+func TestReconcileOnStartupTakesTheMax(t *testing.T) {
+	rf := &revisionFile{counter: 5}
+	rf.reconcileOnStartup(1, 10)
+	if rf.Current() != 10 {
+		t.Fatalf("expected reconcile to raise counter to the watermark(10), got %v", rf.Current())
+	}
+
+	rf2 := &revisionFile{counter: 20}
+	rf2.reconcileOnStartup(1, 10)
+	if rf2.Current() != 20 {
+		t.Fatalf("expected reconcile to leave a counter already ahead of the watermark alone, got %v", rf2.Current())
+	}
+}
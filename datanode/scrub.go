@@ -0,0 +1,329 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package datanode
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/tiglabs/containerfs/storage"
+	"github.com/tiglabs/containerfs/util/log"
+)
+
+// HashBlockSize is the logical block size the scrubber hashes independently, chosen
+// small enough that a single bit-rot event only invalidates one digest entry.
+const HashBlockSize = 2 * 1024 * 1024
+
+// ScrubInterval is the pause between two full passes over a partition's extents.
+const ScrubInterval = 24 * time.Hour
+
+// blockDigest is one entry of the sidecar digest file: the byte range it covers and the
+// SHA-256 of that range as it was last observed on disk.
+type blockDigest struct {
+	Offset uint64
+	Len    uint32
+	Digest [sha256.Size]byte
+}
+
+// scrubState tracks the resume position so a later pass over an extent continues from
+// the last completed block. It is held in memory only: after a restart every extent
+// is hashed again from offset 0.
+type scrubState struct {
+	LastOffset   uint64
+	Mtime        int64
+	InProgress   bool
+}
+
+// hashIndex is the digest index for a single extent/blob file, held in memory so the
+// scrubber and OpExtentHashRange/OpBlobHashRange handlers share one source of truth.
+// Each new digest is also appended to the sidecar file at path; invalidations change
+// only the in-memory list, and the sidecar file is not read back.
+type hashIndex struct {
+	sync.RWMutex
+	path    string
+	blocks  []blockDigest
+	state   scrubState
+}
+
+func newHashIndex(path string) *hashIndex {
+	return &hashIndex{path: path}
+}
+
+// invalidate drops digest entries whose block overlaps [offset, offset+size). Writers
+// must call this before acking a write so the scrubber never reports a stale hash.
+func (h *hashIndex) invalidate(offset uint64, size uint32) {
+	h.Lock()
+	defer h.Unlock()
+	end := offset + uint64(size)
+	kept := h.blocks[:0]
+	for _, b := range h.blocks {
+		if uint64(b.Offset)+uint64(b.Len) <= offset || uint64(b.Offset) >= end {
+			kept = append(kept, b)
+		}
+	}
+	h.blocks = kept
+}
+
+// rangeDigests returns the digest entries covering [start, end), used to answer
+// OpExtentHashRange/OpBlobHashRange requests.
+func (h *hashIndex) rangeDigests(start, end uint64) []blockDigest {
+	h.RLock()
+	defer h.RUnlock()
+	out := make([]blockDigest, 0, len(h.blocks))
+	for _, b := range h.blocks {
+		if uint64(b.Offset) < end && uint64(b.Offset)+uint64(b.Len) > start {
+			out = append(out, b)
+		}
+	}
+	return out
+}
+
+// append adds a freshly computed digest and persists it to the sidecar file. Entries
+// are appended, never rewritten in place, so a crash mid-append only risks losing the
+// last (possibly torn) record rather than corrupting the whole index.
+func (h *hashIndex) append(d blockDigest) error {
+	h.Lock()
+	defer h.Unlock()
+	h.blocks = append(h.blocks, d)
+	f, err := os.OpenFile(h.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return errors.Annotatef(err, "open hash index(%v)", h.path)
+	}
+	defer f.Close()
+	buf := make([]byte, 8+4+sha256.Size)
+	binary.BigEndian.PutUint64(buf[0:8], d.Offset)
+	binary.BigEndian.PutUint32(buf[8:12], d.Len)
+	copy(buf[12:], d.Digest[:])
+	_, err = f.Write(buf)
+	return err
+}
+
+// dataPartitionScrubber walks a partition's extents in HashBlockSize chunks, computing
+// SHA-256 digests and maintaining one hashIndex per extent. It runs as a single
+// goroutine per dataPartition, started alongside the partition's other background
+// loops and stopped when the partition is closed.
+type dataPartitionScrubber struct {
+	dp       *dataPartition
+	indexes  sync.Map // fileID(uint64) -> *hashIndex
+	stopC    chan bool
+}
+
+func newDataPartitionScrubber(dp *dataPartition) *dataPartitionScrubber {
+	return &dataPartitionScrubber{dp: dp, stopC: make(chan bool)}
+}
+
+func (sc *dataPartitionScrubber) start() {
+	go sc.run()
+}
+
+func (sc *dataPartitionScrubber) stop() {
+	close(sc.stopC)
+}
+
+func (sc *dataPartitionScrubber) run() {
+	ticker := time.NewTicker(ScrubInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-sc.stopC:
+			return
+		case <-ticker.C:
+			sc.scrubOnce()
+		}
+	}
+}
+
+func (sc *dataPartitionScrubber) scrubOnce() {
+	store := sc.dp.GetExtentStore()
+	fInfoList, err := store.GetAllWatermark(storage.GetStableExtentFilter())
+	if err != nil {
+		log.LogErrorf("action[scrubOnce] partition(%v) GetAllWatermark err(%v)", sc.dp.ID(), err)
+		return
+	}
+	for _, fInfo := range fInfoList {
+		select {
+		case <-sc.stopC:
+			return
+		default:
+		}
+		if err := sc.scrubExtent(fInfo); err != nil {
+			log.LogErrorf("action[scrubOnce] partition(%v) extent(%v) err(%v)", sc.dp.ID(), fInfo.FileId, err)
+		}
+	}
+}
+
+// scrubExtent hashes one extent in HashBlockSize chunks starting from the resume
+// offset recorded in its hashIndex, reading each block through the same
+// ExtentStore.Read call handleRead uses; it takes no extent lock of its own.
+func (sc *dataPartitionScrubber) scrubExtent(fInfo *storage.FileInfo) error {
+	v, _ := sc.indexes.LoadOrStore(fInfo.FileId, newHashIndex(sc.dp.extentHashIndexPath(fInfo.FileId)))
+	idx := v.(*hashIndex)
+	idx.Lock()
+	idx.state.InProgress = true
+	start := idx.state.LastOffset
+	idx.Unlock()
+
+	store := sc.dp.GetExtentStore()
+	watermark := uint64(fInfo.Size)
+	for off := start; off < watermark; off += HashBlockSize {
+		blockLen := uint32(util64Min(HashBlockSize, int64(watermark-off)))
+		buf := make([]byte, blockLen)
+		if _, err := store.Read(fInfo.FileId, int64(off), int64(blockLen), buf); err != nil {
+			return errors.Annotatef(err, "read block at offset(%v)", off)
+		}
+		digest := blockDigest{Offset: off, Len: blockLen, Digest: sha256.Sum256(buf)}
+		if err := idx.append(digest); err != nil {
+			return errors.Annotatef(err, "append digest at offset(%v)", off)
+		}
+		idx.Lock()
+		idx.state.LastOffset = off + uint64(blockLen)
+		idx.Unlock()
+	}
+	idx.Lock()
+	idx.state.InProgress = false
+	idx.state.Mtime = int64(fInfo.ModifyTime)
+	idx.Unlock()
+	return nil
+}
+
+func util64Min(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// invalidateHash drops any digest entries overlapping a write/delete before it is
+// acked, so the scrubber can never observe and persist a hash for stale data. A
+// size of 0 invalidates the whole file, used by MarkDelete.
+func (s *DataNode) invalidateHash(dpi interface{}, fileID uint64, offset uint64, size uint32) {
+	dp, ok := dpi.(*dataPartition)
+	if !ok || dp.scrubber == nil {
+		return
+	}
+	v, ok := dp.scrubber.indexes.Load(fileID)
+	if !ok {
+		return
+	}
+	idx := v.(*hashIndex)
+	if size == 0 {
+		idx.Lock()
+		idx.blocks = idx.blocks[:0]
+		idx.state = scrubState{}
+		idx.Unlock()
+		return
+	}
+	idx.invalidate(offset, size)
+}
+
+// handleExtentHashRange answers a follower's request for the digest list covering a
+// byte range of one extent, used to drive fine-grained repair instead of the
+// all-or-nothing watermark comparison.
+func (s *DataNode) handleExtentHashRange(pkg *Packet) {
+	dp := pkg.DataPartition.(*dataPartition)
+	buf, err := s.hashRangeReply(dp, pkg.FileID, uint64(pkg.Offset), uint64(pkg.Offset)+uint64(pkg.Size))
+	if err != nil {
+		err = errors.Annotatef(err, "Request(%v) handleExtentHashRange Error", pkg.GetUniqueLogId())
+		pkg.PackErrorBody(LogGetHashRange, err.Error())
+		return
+	}
+	pkg.PackOkWithBody(buf)
+}
+
+// handleBlobHashRange answers the same request for a blob fileID. It looks the fileID
+// up in the same scrubber index as handleExtentHashRange, and the scrubber hashes only
+// ExtentStore extents, so no digests are recorded for BlobStore files.
+func (s *DataNode) handleBlobHashRange(pkg *Packet) {
+	dp := pkg.DataPartition.(*dataPartition)
+	buf, err := s.hashRangeReply(dp, uint64(pkg.FileID), uint64(pkg.Offset), uint64(pkg.Offset)+uint64(pkg.Size))
+	if err != nil {
+		err = errors.Annotatef(err, "Request(%v) handleBlobHashRange Error", pkg.GetUniqueLogId())
+		pkg.PackErrorBody(LogGetHashRange, err.Error())
+		return
+	}
+	pkg.PackOkWithBody(buf)
+}
+
+func (s *DataNode) hashRangeReply(dp *dataPartition, fileID, start, end uint64) ([]byte, error) {
+	if dp.scrubber == nil {
+		return nil, errors.New("scrubber not running on this partition")
+	}
+	v, ok := dp.scrubber.indexes.Load(fileID)
+	if !ok {
+		return nil, errors.Errorf("no digest index for file(%v)", fileID)
+	}
+	idx := v.(*hashIndex)
+	return json.Marshal(idx.rangeDigests(start, end))
+}
+
+// diffDigests compares each remote digest against the local index by offset and returns
+// the entries that diverge, so the requester knows which byte range to re-read. A remote
+// offset this side has no digest for yet is reported using the remote entry's own range
+// (there is no local range to report instead), and one the local side has hashed
+// differently is reported using the local entry, since that is the range the requester
+// needs to re-fetch.
+func diffDigests(remote []blockDigest, local map[uint64]blockDigest) []blockDigest {
+	diverging := make([]blockDigest, 0)
+	for _, rb := range remote {
+		lb, ok := local[rb.Offset]
+		if !ok {
+			diverging = append(diverging, rb)
+			continue
+		}
+		if lb.Digest != rb.Digest {
+			diverging = append(diverging, lb)
+		}
+	}
+	return diverging
+}
+
+// handleNotifyHashRepair behaves like handleNotifyExtentRepair but, instead of
+// streaming a full replica copy, diffs the requester's digest list against the local
+// one and replies with only the diverging digest entries; it sends no block data, and
+// the caller re-reads and re-writes those ranges itself.
+func (s *DataNode) handleNotifyHashRepair(pkg *Packet) {
+	var remote []blockDigest
+	if err := json.Unmarshal(pkg.Data, &remote); err != nil {
+		pkg.PackErrorBody(LogHashRepair, err.Error())
+		return
+	}
+	dp := pkg.DataPartition.(*dataPartition)
+	if dp.scrubber == nil {
+		pkg.PackErrorBody(LogHashRepair, "scrubber not running on this partition")
+		return
+	}
+	v, ok := dp.scrubber.indexes.Load(pkg.FileID)
+	if !ok {
+		pkg.PackErrorBody(LogHashRepair, errors.Errorf("no digest index for file(%v)", pkg.FileID).Error())
+		return
+	}
+	local := v.(*hashIndex).rangeDigests(0, ^uint64(0))
+	localByOffset := make(map[uint64]blockDigest, len(local))
+	for _, b := range local {
+		localByOffset[b.Offset] = b
+	}
+	diverging := diffDigests(remote, localByOffset)
+	buf, err := json.Marshal(diverging)
+	if err != nil {
+		pkg.PackErrorBody(LogHashRepair, err.Error())
+		return
+	}
+	pkg.PackOkWithBody(buf)
+}
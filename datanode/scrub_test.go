@@ -0,0 +1,53 @@
+// Copyright 2018 The Containerfs Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package datanode
+
+import "testing"
+
+func TestDiffDigestsReportsRemoteRangeWhenLocalMissing(t *testing.T) {
+	remote := []blockDigest{{Offset: 100, Len: 10, Digest: [32]byte{1}}}
+	local := map[uint64]blockDigest{}
+
+	diverging := diffDigests(remote, local)
+
+	if len(diverging) != 1 {
+		t.Fatalf("expected 1 diverging entry, got %v", len(diverging))
+	}
+	if diverging[0].Offset != 100 || diverging[0].Len != 10 {
+		t.Fatalf("expected the remote entry's own range, got offset(%v) len(%v)", diverging[0].Offset, diverging[0].Len)
+	}
+}
+
+func TestDiffDigestsReportsLocalRangeWhenDigestsDiffer(t *testing.T) {
+	remote := []blockDigest{{Offset: 100, Len: 10, Digest: [32]byte{1}}}
+	local := map[uint64]blockDigest{100: {Offset: 100, Len: 10, Digest: [32]byte{2}}}
+
+	diverging := diffDigests(remote, local)
+
+	if len(diverging) != 1 || diverging[0].Digest != local[100].Digest {
+		t.Fatalf("expected the local entry to be reported, got %v", diverging)
+	}
+}
+
+func TestDiffDigestsSkipsMatchingBlocks(t *testing.T) {
+	remote := []blockDigest{{Offset: 100, Len: 10, Digest: [32]byte{1}}}
+	local := map[uint64]blockDigest{100: {Offset: 100, Len: 10, Digest: [32]byte{1}}}
+
+	diverging := diffDigests(remote, local)
+
+	if len(diverging) != 0 {
+		t.Fatalf("expected no diverging entries, got %v", diverging)
+	}
+}
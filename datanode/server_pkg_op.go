@@ -32,7 +32,8 @@ import (
 )
 
 var (
-	ErrorUnknownOp = errors.New("unknown opcode")
+	ErrorUnknownOp    = errors.New("unknown opcode")
+	ErrNotECPartition = errors.New("dataPartition is not an EC partition")
 )
 
 func (s *DataNode) operatePacket(pkg *Packet, c *net.TCPConn) {
@@ -62,6 +63,14 @@ func (s *DataNode) operatePacket(pkg *Packet, c *net.TCPConn) {
 		pkg.Size = resultSize
 		ump.AfterTP(tpObject, err)
 	}()
+	if isMutatingOpcode(pkg.Opcode) {
+		if dp, ok := pkg.DataPartition.(*dataPartition); ok {
+			if revErr := s.checkRevision(dp, pkg.ExpectedRevision); revErr != nil {
+				pkg.PackErrorBody(revErr.Error(), revErr.Error())
+				return
+			}
+		}
+	}
 	switch pkg.Opcode {
 	case proto.OpCreateFile:
 		s.handleCreateFile(pkg)
@@ -97,6 +106,22 @@ func (s *DataNode) operatePacket(pkg *Packet, c *net.TCPConn) {
 		s.handleHeartbeats(pkg)
 	case proto.OpGetDataPartitionMetrics:
 		s.handleGetDataPartitionMetrics(pkg)
+	case proto.OpECWrite:
+		s.handleECWrite(pkg)
+	case proto.OpECRead:
+		s.handleECRead(pkg)
+	case proto.OpECReconstruct:
+		s.handleECReconstruct(pkg)
+	case opECShardTransfer:
+		s.handleECShardTransfer(pkg)
+	case proto.OpExtentHashRange:
+		s.handleExtentHashRange(pkg)
+	case proto.OpBlobHashRange:
+		s.handleBlobHashRange(pkg)
+	case proto.OpNotifyHashRepair:
+		s.handleNotifyHashRepair(pkg)
+	case proto.OpSubscribePartitionLog:
+		s.handleSubscribePartitionLog(pkg, c)
 	default:
 		pkg.PackErrorBody(ErrorUnknownOp.Error(), ErrorUnknownOp.Error()+strconv.Itoa(int(pkg.Opcode)))
 	}
@@ -132,6 +157,10 @@ func (s *DataNode) handleCreateFile(pkg *Packet) {
 			ino = binary.BigEndian.Uint64(pkg.Data)
 		}
 		err = pkg.DataPartition.GetExtentStore().Create(pkg.FileID, ino, false)
+		if err == nil {
+			s.recordMutation(pkg.DataPartition, pkg.Opcode, pkg.FileID, 0, 0, 0)
+			s.bumpRevision(pkg.DataPartition)
+		}
 	}
 	return
 }
@@ -146,7 +175,7 @@ func (s *DataNode) handleCreateDataPartition(pkg *Packet) {
 	if task.OpCode == proto.OpCreateDataPartition {
 		bytes, _ := json.Marshal(task.Request)
 		json.Unmarshal(bytes, request)
-		if _, err := s.space.CreatePartition(request.VolumeId, uint32(request.PartitionId),
+		if dp, err := s.space.CreatePartition(request.VolumeId, uint32(request.PartitionId),
 			request.PartitionSize, request.PartitionType); err != nil {
 			response.PartitionId = uint64(request.PartitionId)
 			response.Status = proto.TaskFail
@@ -155,6 +184,23 @@ func (s *DataNode) handleCreateDataPartition(pkg *Packet) {
 		} else {
 			response.Status = proto.TaskSuccess
 			response.PartitionId = request.PartitionId
+			var ecParams ecCreateParams
+			if json.Unmarshal(bytes, &ecParams) == nil && ecParams.DataShards > 0 {
+				if ecDp, ok := dp.(*dataPartition); ok {
+					ecDp.ecMeta = &ecShardMeta{
+						DataShards:   ecParams.DataShards,
+						ParityShards: ecParams.ParityShards,
+						ShardIndex:   ecParams.ShardIndex,
+						Peers:        ecParams.Peers,
+					}
+				}
+			}
+			var chunkParams chunkPlacementParams
+			if json.Unmarshal(bytes, &chunkParams) == nil && len(chunkParams.Hosts) > 0 {
+				if chunkDp, ok := dp.(*dataPartition); ok {
+					chunkDp.chunkHosts = chunkParams.Hosts
+				}
+			}
 		}
 	} else {
 		response.PartitionId = uint64(request.PartitionId)
@@ -182,6 +228,7 @@ func (s *DataNode) handleHeartbeats(pkg *Packet) {
 	response := &proto.DataNodeHeartBeatResponse{}
 
 	s.fillHeartBeatResponse(response)
+	response.PartitionRevisions = s.collectPartitionRevisions()
 
 	if task.OpCode == proto.OpDataNodeHeartbeat {
 		bytes, _ := json.Marshal(task.Request)
@@ -260,8 +307,12 @@ func (s *DataNode) handleLoadDataPartition(pkg *Packet) {
 			response.Result = fmt.Sprintf("dataPartition(%v) not found", request.PartitionId)
 			log.LogErrorf("from master Task(%v) failed,error(%v)", task.ToString(), response.Result)
 		} else {
-			response = dp.(*dataPartition).Load()
+			loadedDp := dp.(*dataPartition)
+			response = loadedDp.Load()
 			response.PartitionId = uint64(request.PartitionId)
+			if rf := s.ensureRevisionFile(loadedDp); rf != nil {
+				response.Revision = rf.Current()
+			}
 		}
 	} else {
 		response.PartitionId = uint64(request.PartitionId)
@@ -283,14 +334,18 @@ func (s *DataNode) handleMarkDelete(pkg *Packet) {
 	var err error
 	switch pkg.StoreMode {
 	case proto.BlobStoreMode:
+		s.invalidateHash(pkg.DataPartition, uint64(pkg.FileID), uint64(pkg.Offset), uint32(pkg.Size))
 		err = pkg.DataPartition.GetBlobStore().MarkDelete(uint32(pkg.FileID), pkg.Offset, int64(pkg.Size))
 	case proto.ExtentStoreMode:
+		s.invalidateHash(pkg.DataPartition, pkg.FileID, 0, 0)
 		err = pkg.DataPartition.GetExtentStore().MarkDelete(pkg.FileID)
 	}
 	if err != nil {
 		err = errors.Annotatef(err, "Request(%v) MarkDelete Error", pkg.GetUniqueLogId())
 		pkg.PackErrorBody(LogMarkDel, err.Error())
 	} else {
+		s.recordMutation(pkg.DataPartition, pkg.Opcode, pkg.FileID, pkg.Offset, uint32(pkg.Size), 0)
+		s.bumpRevision(pkg.DataPartition)
 		pkg.PackOkReply()
 	}
 
@@ -318,11 +373,27 @@ func (s *DataNode) handleWrite(pkg *Packet) {
 	}
 	switch pkg.StoreMode {
 	case proto.BlobStoreMode:
+		s.invalidateHash(pkg.DataPartition, uint64(pkg.FileID), uint64(pkg.Offset), pkg.Size)
 		err = pkg.DataPartition.GetBlobStore().Write(uint32(pkg.FileID), uint64(pkg.Offset), int64(pkg.Size), pkg.Data, pkg.Crc)
 		s.addDiskErrs(pkg.PartitionID, err, WriteFlag)
 	case proto.ExtentStoreMode:
+		s.invalidateHash(pkg.DataPartition, pkg.FileID, uint64(pkg.Offset), pkg.Size)
+		if dp, ok := pkg.DataPartition.(*dataPartition); ok && pkg.Offset == 0 && pkg.Size > ChunkedObjectThreshold {
+			body := pkg.Data[:pkg.Size]
+			err = s.writeChunkedObject(dp, pkg.FileID, chunkedObjectFileIDs(pkg.FileID, body), dp.chunkHosts, body, crc32OfChunk(body))
+			s.addDiskErrs(pkg.PartitionID, err, WriteFlag)
+			if err == nil {
+				s.recordMutation(pkg.DataPartition, pkg.Opcode, pkg.FileID, pkg.Offset, pkg.Size, pkg.Crc)
+				s.bumpRevision(pkg.DataPartition)
+			}
+			break
+		}
 		err = pkg.DataPartition.GetExtentStore().Write(pkg.FileID, pkg.Offset, int64(pkg.Size), pkg.Data, pkg.Crc)
 		s.addDiskErrs(pkg.PartitionID, err, WriteFlag)
+		if err == nil {
+			s.recordMutation(pkg.DataPartition, pkg.Opcode, pkg.FileID, pkg.Offset, pkg.Size, pkg.Crc)
+			s.bumpRevision(pkg.DataPartition)
+		}
 		if err == nil && pkg.Opcode == proto.OpWrite && pkg.Size == util.BlockSize {
 			proto.Buffers.Put(pkg.Data)
 		}
@@ -339,6 +410,15 @@ func (s *DataNode) handleRead(pkg *Packet) {
 		pkg.Crc, err = pkg.DataPartition.GetBlobStore().Read(uint32(pkg.FileID), pkg.Offset, int64(pkg.Size), pkg.Data)
 		s.addDiskErrs(pkg.PartitionID, err, ReadFlag)
 	case proto.ExtentStoreMode:
+		if m, mErr := s.loadManifestIfAny(pkg); mErr == nil && m != nil {
+			var buf []byte
+			buf, err = s.readManifestRange(pkg.DataPartition.(*dataPartition), m, pkg.Offset, int64(pkg.Size))
+			pkg.Data = buf
+			if err == nil {
+				pkg.Crc = crc32OfChunk(buf)
+			}
+			break
+		}
 		pkg.Crc, err = pkg.DataPartition.GetExtentStore().Read(pkg.FileID, pkg.Offset, int64(pkg.Size), pkg.Data)
 		s.addDiskErrs(pkg.PartitionID, err, ReadFlag)
 	}
@@ -359,6 +439,10 @@ func (s *DataNode) handleStreamRead(request *Packet, connect net.Conn) {
 	needReplySize := request.Size
 	offset := request.Offset
 	store := request.DataPartition.GetExtentStore()
+	if m, mErr := s.loadManifestIfAny(request); mErr == nil && m != nil {
+		s.handleStreamReadManifest(request, connect, m)
+		return
+	}
 	umpKey := fmt.Sprintf("%s_datanode_%s", s.clusterId, "Read")
 	for {
 		if needReplySize <= 0 {
@@ -505,6 +589,27 @@ func (s *DataNode) handleNotifyExtentRepair(pkg *Packet) {
 		pkg.PackErrorBody(LogRepair, err.Error())
 		return
 	}
+	dp := pkg.DataPartition.(*dataPartition)
+	if dp.ecMeta != nil {
+		for _, fileID := range missingECShardFileIDs(dp, mf) {
+			fInfo := mf.Files[fileID]
+			if fInfo == nil {
+				continue
+			}
+			if repairErr := dp.repairECShard(s, fileID, fInfo.Size); repairErr != nil {
+				log.LogErrorf("action[handleNotifyExtentRepair] rebuild ECShard(%v) of partition(%v) failed(%v)",
+					fileID, dp.ID(), repairErr)
+			}
+		}
+		pkg.PackOkReply()
+		return
+	}
+	if rf := s.ensureRevisionFile(dp); rf != nil && mf.SourceRevision != 0 && mf.SourceRevision < rf.Current() {
+		err = errors.Annotatef(ErrRevisionMismatch, "refusing to repair from stale source(revision=%v, local=%v)",
+			mf.SourceRevision, rf.Current())
+		pkg.PackErrorBody(LogRepair, err.Error())
+		return
+	}
 	pkg.DataPartition.MergeExtentStoreRepair(mf)
 	pkg.PackOkReply()
 	return